@@ -0,0 +1,303 @@
+package network
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// backend wires up the constructors needed to run the same test body
+// against a given Conn/Listener/Host implementation.
+type backend struct {
+	name        string
+	newListener func(addr Address) (Listener, error)
+	newConn     func(local, remote Address) (Conn, error)
+	newHost     func(local Address) (Host, error)
+}
+
+var backends = []backend{
+	{
+		name: "local",
+		newListener: func(addr Address) (Listener, error) {
+			return NewLocalListener(addr)
+		},
+		newConn: func(local, remote Address) (Conn, error) {
+			return NewLocalConn(local, remote)
+		},
+		newHost: func(local Address) (Host, error) {
+			return NewLocalHost(local)
+		},
+	},
+	{
+		name: "tcp",
+		newListener: func(addr Address) (Listener, error) {
+			return NewTCPListener(NewLocalAddress("127.0.0.1:0"))
+		},
+		newConn: func(local, remote Address) (Conn, error) {
+			return NewTCPConn(remote)
+		},
+		newHost: func(local Address) (Host, error) {
+			return NewTCPHost(NewLocalAddress("127.0.0.1:0"))
+		},
+	},
+}
+
+// nextLocalPort hands out fresh ports so concurrent tests running against
+// the local backend never fight over the same address in defaultLocalManager.
+var nextLocalPort uint32 = 3000
+
+func nextAddr() Address {
+	port := atomic.AddUint32(&nextLocalPort, 1)
+	return NewLocalAddress("127.0.0.1:" + strconv.Itoa(int(port)))
+}
+
+// listenerAddr returns the Address a just-created Listener actually ended
+// up bound to (it may differ from the requested one, e.g. TCP port 0).
+func listenerAddr(l Listener, requested Address) Address {
+	if a, ok := l.(interface{ Addr() Address }); ok {
+		return a.Addr()
+	}
+	return requested
+}
+
+// waitListening polls mgr until addr is registered, or gives up. Every test
+// that spins up a LocalListener in its own goroutine and then immediately
+// dials it needs this: LocalListener.Listen only registers with mgr once
+// its goroutine actually starts running, so merely observing that the
+// goroutine started (e.g. via a "ready" channel) is not enough to guarantee
+// a concurrent dial will find it.
+func waitListening(mgr *LocalManager, addr Address) bool {
+	for i := 0; i < 50; i++ {
+		if mgr.isListening(addr) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// waitReady is waitListening for a just-created Listener of unknown backend:
+// for a LocalListener it polls the manager it's registered with; a TCP
+// listener's socket is already bound synchronously by NewTCPListener, before
+// Listen is even called, so there's nothing to wait for there.
+func waitReady(l Listener, addr Address) bool {
+	ll, ok := l.(*LocalListener)
+	if !ok {
+		return true
+	}
+	return waitListening(ll.manager, addr)
+}
+
+func TestConnCloseReceive(t *testing.T) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			requested := nextAddr()
+			listener, err := b.newListener(requested)
+			if err != nil {
+				t.Fatal("Could not listen", err)
+			}
+			addr := listenerAddr(listener, requested)
+
+			var ready = make(chan bool)
+			go func() {
+				ready <- true
+				listener.Listen(func(c Conn) {
+					ready <- true
+					assert.Nil(t, c.Close())
+				})
+			}()
+			<-ready
+			if !waitReady(listener, addr) {
+				t.Fatal("listener never came up")
+			}
+
+			outgoing, err := b.newConn(nextAddr(), addr)
+			if err != nil {
+				t.Fatal("could not dial:", err)
+			}
+			<-ready
+
+			_, err = outgoing.Receive(context.TODO())
+			assert.Equal(t, ErrClosed, err)
+			assert.Equal(t, ErrClosed, outgoing.Close())
+			assert.Nil(t, listener.Stop())
+		})
+	}
+}
+
+func TestConnDiffAddress(t *testing.T) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			testConn(t, b)
+		})
+	}
+}
+
+func testConn(t *testing.T, b backend) {
+	requested := nextAddr()
+	listener, err := b.newListener(requested)
+	if err != nil {
+		t.Fatal("Could not listen", err)
+	}
+	addr := listenerAddr(listener, requested)
+
+	var ready = make(chan bool)
+	var incomingConn = make(chan bool)
+	var outgoingConn = make(chan bool)
+	go func() {
+		ready <- true
+		listener.Listen(func(c Conn) {
+			incomingConn <- true
+			nm, err := c.Receive(context.TODO())
+			assert.Nil(t, err)
+			assert.Equal(t, 3, nm.Msg.(SimpleMessage).I)
+			// acknowledge the message
+			incomingConn <- true
+			err = c.Send(context.TODO(), &SimpleMessage{3})
+			assert.Nil(t, err)
+			// wait ack
+			<-outgoingConn
+			// close connection
+			assert.Nil(t, c.Close())
+		})
+		ready <- true
+	}()
+	<-ready
+	if !waitReady(listener, addr) {
+		t.Fatal("listener never came up")
+	}
+
+	outgoing, err := b.newConn(nextAddr(), addr)
+	if err != nil {
+		t.Fatal("could not dial:", err)
+	}
+
+	// check if connection is opened on the listener
+	<-incomingConn
+	// send stg and wait for ack
+	assert.Nil(t, outgoing.Send(context.TODO(), &SimpleMessage{3}))
+	<-incomingConn
+
+	// receive stg and send ack
+	nm, err := outgoing.Receive(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, nm.Msg.(SimpleMessage).I)
+	outgoingConn <- true
+
+	// close the incoming conn, so Receive here should return an error
+	nm, err = outgoing.Receive(context.TODO())
+	if err != ErrClosed {
+		t.Error("Receive should have returned an error")
+	}
+	assert.Equal(t, ErrClosed, outgoing.Close())
+
+	// close the listener
+	assert.Nil(t, listener.Stop())
+	<-ready
+}
+
+func TestManyConn(t *testing.T) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			nbrConn := 3
+			requested := nextAddr()
+			listener, err := b.newListener(requested)
+			if err != nil {
+				t.Fatal("Could not setup listener:", err)
+			}
+			addr := listenerAddr(listener, requested)
+
+			var wg sync.WaitGroup
+			var ready = make(chan bool)
+			go func() {
+				ready <- true
+				listener.Listen(func(c Conn) {
+					_, err := c.Receive(context.TODO())
+					assert.Nil(t, err)
+
+					assert.Nil(t, c.Send(context.TODO(), &SimpleMessage{3}))
+				})
+			}()
+			<-ready
+			if !waitReady(listener, addr) {
+				t.Fatal("listener never came up")
+			}
+
+			wg.Add(nbrConn)
+			for i := 0; i < nbrConn; i++ {
+				go func() {
+					defer wg.Done()
+					c, err := b.newConn(nextAddr(), addr)
+					if !assert.Nil(t, err) {
+						return
+					}
+					assert.Nil(t, c.Send(context.TODO(), &SimpleMessage{3}))
+					nm, err := c.Receive(context.TODO())
+					assert.Nil(t, err)
+					assert.Equal(t, 3, nm.Msg.(SimpleMessage).I)
+					assert.Nil(t, c.Close())
+				}()
+			}
+
+			wg.Wait()
+			listener.Stop()
+		})
+	}
+}
+
+// TestContext checks that a Receive blocked on the network returns as soon
+// as its context is cancelled, without needing the remote side to send or
+// close anything.
+func TestContext(t *testing.T) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			requested := nextAddr()
+			listener, err := b.newListener(requested)
+			if err != nil {
+				t.Fatal("Could not setup listener:", err)
+			}
+			addr := listenerAddr(listener, requested)
+
+			var ready = make(chan bool)
+			go func() {
+				ready <- true
+				listener.Listen(func(c Conn) {
+					<-make(chan struct{}) // never respond, hold the conn open
+				})
+			}()
+			<-ready
+			if !waitReady(listener, addr) {
+				t.Fatal("listener never came up")
+			}
+
+			outgoing, err := b.newConn(nextAddr(), addr)
+			if err != nil {
+				t.Fatal("could not dial:", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				_, err := outgoing.Receive(ctx)
+				done <- err
+			}()
+			cancel()
+
+			err = <-done
+			assert.Equal(t, context.Canceled, err)
+
+			outgoing.Close()
+			listener.Stop()
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ConnInfo snapshots one open connection's identity, traffic counters and
+// timestamps, as returned by Host.Diagnose.
+type ConnInfo struct {
+	Local         Address
+	Remote        Address
+	BytesSent     uint64
+	BytesReceived uint64
+	OpenedAt      time.Time
+	LastActivity  time.Time
+	Protocol      string
+}
+
+// ListenerStats is what Listener.Stats returns: how many connections a
+// Listener has accepted in total, how many are currently open, and a
+// breakdown of the open ones by remote address.
+type ListenerStats struct {
+	Accepted         int
+	Active           int
+	PerRemoteAddress map[Address]int
+}
+
+// connStatsProvider is implemented by every Conn that carries a connStats
+// (LocalConn, TCPConn), so the Host/Listener wiring can register and read
+// it through a plain type assertion instead of each transport
+// reimplementing Diagnose/Stats itself.
+type connStatsProvider interface {
+	connStats() *connStats
+}
+
+// connStats is held by every Conn implementation that wants to show up
+// in Host.Diagnose / Listener.Stats: LocalConn and TCPConn update it on
+// every Send/Receive, the Host or Listener that created the conn registers
+// it with its connRegistry, and the conn unregisters it on Close.
+type connStats struct {
+	local, remote Address
+	protocol      string
+	openedAt      time.Time
+
+	bytesSent     uint64
+	bytesReceived uint64
+	lastActivity  int64 // unix nano, accessed atomically
+
+	registry *connRegistry
+}
+
+func newConnStats(local, remote Address, protocol string) *connStats {
+	return &connStats{
+		local:        local,
+		remote:       remote,
+		protocol:     protocol,
+		openedAt:     time.Now(),
+		lastActivity: time.Now().UnixNano(),
+	}
+}
+
+func (s *connStats) recordSent(n int) {
+	atomic.AddUint64(&s.bytesSent, uint64(n))
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *connStats) recordReceived(n int) {
+	atomic.AddUint64(&s.bytesReceived, uint64(n))
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *connStats) info() *ConnInfo {
+	return &ConnInfo{
+		Local:         s.local,
+		Remote:        s.remote,
+		BytesSent:     atomic.LoadUint64(&s.bytesSent),
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		OpenedAt:      s.openedAt,
+		LastActivity:  time.Unix(0, atomic.LoadInt64(&s.lastActivity)),
+		Protocol:      s.protocol,
+	}
+}
+
+// closed tells the registry this conn was closed, so it stops counting
+// towards Active/Diagnose but keeps counting towards Accepted.
+func (s *connStats) closed() {
+	if s.registry != nil {
+		s.registry.remove(s)
+	}
+}
+
+// connRegistry backs one Host's or Listener's diagnostics: every conn it
+// creates (dialed or accepted) is added on creation and removed on Close.
+type connRegistry struct {
+	mu        sync.Mutex
+	conns     map[*connStats]bool
+	accepted  int
+	perRemote map[Address]int
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns:     make(map[*connStats]bool),
+		perRemote: make(map[Address]int),
+	}
+}
+
+func (r *connRegistry) add(s *connStats) {
+	s.registry = r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[s] = true
+	r.accepted++
+	r.perRemote[s.remote]++
+}
+
+func (r *connRegistry) remove(s *connStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.conns[s] {
+		return
+	}
+	delete(r.conns, s)
+	r.perRemote[s.remote]--
+	if r.perRemote[s.remote] <= 0 {
+		delete(r.perRemote, s.remote)
+	}
+}
+
+func (r *connRegistry) snapshot() []*ConnInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*ConnInfo, 0, len(r.conns))
+	for s := range r.conns {
+		out = append(out, s.info())
+	}
+	return out
+}
+
+func (r *connRegistry) stats() ListenerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	perRemote := make(map[Address]int, len(r.perRemote))
+	for addr, n := range r.perRemote {
+		perRemote[addr] = n
+	}
+	return ListenerStats{Accepted: r.accepted, Active: len(r.conns), PerRemoteAddress: perRemote}
+}
+
+// diagnoseRequest/diagnoseResponse are the reserved control messages
+// DiagnoseNetwork uses to ask a peer, over a dedicated connection, for its
+// own view of the network.
+type diagnoseRequest struct {
+	Depth int
+}
+
+var diagnoseRequestType = RegisterPacketType(&diagnoseRequest{})
+
+type diagnoseResponse struct {
+	Conns []*ConnInfo
+	Peers map[Address][]*ConnInfo
+}
+
+var diagnoseResponseType = RegisterPacketType(&diagnoseResponse{})
+
+// NewDiagnosticsListener wraps inner so that any connection whose very
+// first message is a diagnoseRequest is answered with host.Diagnose (and,
+// if Depth > 0, recursively with its own peers' diagnostics) instead of
+// being handed to fn. Every other connection reaches fn once its first
+// message has arrived, with that message replayed transparently; a
+// connection that fails or closes before sending anything is closed and
+// never reaches fn.
+func NewDiagnosticsListener(inner Listener, host Host) Listener {
+	return &diagnosticsListener{inner: inner, host: host}
+}
+
+type diagnosticsListener struct {
+	inner Listener
+	host  Host
+}
+
+func (l *diagnosticsListener) Listen(fn func(Conn)) error {
+	return l.inner.Listen(func(c Conn) {
+		p, err := c.Receive(context.Background())
+		if err != nil {
+			c.Close()
+			return
+		}
+		if req, ok := p.Msg.(diagnoseRequest); ok {
+			handleDiagnoseRequest(c, l.host, req)
+			return
+		}
+		fn(&peekedConn{Conn: c, first: p, hasFirst: true})
+	})
+}
+
+func (l *diagnosticsListener) Stop() error {
+	return l.inner.Stop()
+}
+
+func (l *diagnosticsListener) Stats() ListenerStats {
+	return l.inner.Stats()
+}
+
+// peekedConn replays a single already-Received Packet before falling
+// through to the wrapped Conn, so diagnosticsListener can peek at a
+// connection's first message without losing it for the real handler.
+type peekedConn struct {
+	Conn
+	mu       sync.Mutex
+	first    Packet
+	hasFirst bool
+}
+
+func (p *peekedConn) Receive(ctx context.Context) (Packet, error) {
+	p.mu.Lock()
+	if p.hasFirst {
+		p.hasFirst = false
+		pkt := p.first
+		p.mu.Unlock()
+		return pkt, nil
+	}
+	p.mu.Unlock()
+	return p.Conn.Receive(ctx)
+}
+
+func handleDiagnoseRequest(c Conn, host Host, req diagnoseRequest) {
+	defer c.Close()
+
+	conns, err := host.Diagnose(context.Background())
+	if err != nil {
+		return
+	}
+	resp := diagnoseResponse{Conns: conns}
+	if req.Depth > 0 {
+		resp.Peers = make(map[Address][]*ConnInfo)
+		for _, ci := range conns {
+			peerConns, err := queryDiagnostics(host, ci.Remote, req.Depth-1)
+			if err != nil {
+				continue
+			}
+			resp.Peers[ci.Remote] = peerConns
+		}
+	}
+	c.Send(context.Background(), &resp)
+}
+
+// queryDiagnostics dials remote on host, asks it for its own Diagnose
+// output (recursing depth levels further, if requested), and returns it.
+// Only the remote's own Conns are returned; the Peers in its reply are
+// dropped.
+func queryDiagnostics(host Host, remote Address, depth int) ([]*ConnInfo, error) {
+	c, err := host.Connect(remote)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.Send(context.Background(), &diagnoseRequest{Depth: depth}); err != nil {
+		return nil, err
+	}
+	p, err := c.Receive(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := p.Msg.(diagnoseResponse)
+	if !ok {
+		return nil, fmt.Errorf("network: unexpected diagnostics reply type %T", p.Msg)
+	}
+	return resp.Conns, nil
+}
+
+// diagnoseNetwork is the shared implementation behind
+// Host.DiagnoseNetwork: it reports self's own Diagnose output plus, for
+// depth > 0, every directly connected peer's.
+func diagnoseNetwork(ctx context.Context, self Address, host Host, depth int) (map[Address][]*ConnInfo, error) {
+	conns, err := host.Diagnose(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := map[Address][]*ConnInfo{self: conns}
+	if depth <= 0 {
+		return out, nil
+	}
+	for _, ci := range conns {
+		peerConns, err := queryDiagnostics(host, ci.Remote, depth-1)
+		if err != nil {
+			continue
+		}
+		out[ci.Remote] = peerConns
+	}
+	return out, nil
+}
@@ -0,0 +1,116 @@
+package network
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDiagnoseTracksTraffic checks that Host.Diagnose and Listener.Stats
+// report the connections each side made/accepted and their observed
+// traffic, for both the local and TCP backends.
+func TestDiagnoseTracksTraffic(t *testing.T) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			requested := nextAddr()
+			listener, err := b.newListener(requested)
+			assert.Nil(t, err)
+			addr := listenerAddr(listener, requested)
+
+			var ready = make(chan bool)
+			var got = make(chan bool)
+			go func() {
+				ready <- true
+				listener.Listen(func(c Conn) {
+					_, err := c.Receive(context.TODO())
+					assert.Nil(t, err)
+					got <- true
+				})
+			}()
+			<-ready
+
+			host, err := b.newHost(nextAddr())
+			assert.Nil(t, err)
+
+			outgoing, err := host.Connect(addr)
+			assert.Nil(t, err)
+			assert.Nil(t, outgoing.Send(context.TODO(), &SimpleMessage{3}))
+			<-got
+
+			conns, err := host.Diagnose(context.TODO())
+			assert.Nil(t, err)
+			if assert.Len(t, conns, 1) {
+				assert.Equal(t, addr, conns[0].Remote)
+				assert.True(t, conns[0].BytesSent > 0)
+			}
+
+			stats := listener.Stats()
+			assert.Equal(t, 1, stats.Accepted)
+			assert.Equal(t, 1, stats.Active)
+
+			assert.Nil(t, outgoing.Close())
+			assert.Nil(t, listener.Stop())
+		})
+	}
+}
+
+// TestDiagnoseNetworkRecurses checks that DiagnoseNetwork reports not only
+// a host's own connections but, one level deep, a directly connected
+// peer's own Diagnose output too, fetched over a reserved control message.
+func TestDiagnoseNetworkRecurses(t *testing.T) {
+	mgr := NewLocalManager()
+
+	// node C: a third party that the server dials out to, purely so the
+	// server's own Diagnose() has something to report back to the client.
+	addrC := nextAddr()
+	listenerC, err := NewLocalListenerWithManager(mgr, addrC)
+	assert.Nil(t, err)
+	go listenerC.Listen(func(c Conn) {
+		<-make(chan struct{}) // hold the conn open
+	})
+	if !waitListening(mgr, addrC) {
+		t.Fatal("listener never came up")
+	}
+
+	serverAddr := nextAddr()
+	server, err := NewLocalHostWithManager(mgr, serverAddr)
+	assert.Nil(t, err)
+	serverToC, err := server.Connect(addrC)
+	assert.Nil(t, err)
+	defer serverToC.Close()
+
+	rawListener, err := NewLocalListenerWithManager(mgr, serverAddr)
+	assert.Nil(t, err)
+	diagListener := NewDiagnosticsListener(rawListener, server)
+	go diagListener.Listen(func(c Conn) {
+		<-make(chan struct{}) // hold the conn open
+	})
+	if !waitListening(mgr, serverAddr) {
+		t.Fatal("listener never came up")
+	}
+
+	clientAddr := nextAddr()
+	client, err := NewLocalHostWithManager(mgr, clientAddr)
+	assert.Nil(t, err)
+
+	outgoing, err := client.Connect(serverAddr)
+	assert.Nil(t, err)
+	defer outgoing.Close()
+
+	topology, err := client.DiagnoseNetwork(context.TODO(), 1)
+	assert.Nil(t, err)
+	if assert.Contains(t, topology, clientAddr) {
+		assert.Len(t, topology[clientAddr], 1)
+	}
+	if assert.Contains(t, topology, serverAddr) {
+		if assert.Len(t, topology[serverAddr], 1) {
+			assert.Equal(t, addrC, topology[serverAddr][0].Remote)
+		}
+	}
+
+	diagListener.Stop()
+	listenerC.Stop()
+}
@@ -0,0 +1,316 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultLocalManager is the LocalManager used by NewLocalListener,
+// NewLocalConn and NewLocalHost when no explicit manager is given. Tests
+// that need isolated networks should create their own with NewLocalManager.
+var defaultLocalManager = NewLocalManager()
+
+// LocalManager simulates a local network: it keeps track of which
+// addresses are currently listening (for LocalConn) or bound to a
+// LocalPacketConn (see packet.go) so sends can be routed without touching
+// any real socket, and of the fault-injection knobs (latency, bandwidth,
+// loss, partitions, see local_faults.go) that govern how and when a sent
+// Packet actually reaches its destination channel.
+type LocalManager struct {
+	sync.Mutex
+	listeners   map[Address]func(Conn)
+	packetConns map[Address]chan Envelope
+	faults      *faultState
+}
+
+// NewLocalManager returns a fresh, empty LocalManager.
+func NewLocalManager() *LocalManager {
+	return &LocalManager{
+		listeners:   make(map[Address]func(Conn)),
+		packetConns: make(map[Address]chan Envelope),
+		faults:      newFaultState(),
+	}
+}
+
+func (lm *LocalManager) isListening(addr Address) bool {
+	lm.Lock()
+	defer lm.Unlock()
+	_, ok := lm.listeners[addr]
+	return ok
+}
+
+func (lm *LocalManager) register(addr Address, fn func(Conn)) error {
+	lm.Lock()
+	defer lm.Unlock()
+	if _, ok := lm.listeners[addr]; ok {
+		return fmt.Errorf("network: %s is already listening", addr)
+	}
+	lm.listeners[addr] = fn
+	return nil
+}
+
+func (lm *LocalManager) unregister(addr Address) {
+	lm.Lock()
+	defer lm.Unlock()
+	delete(lm.listeners, addr)
+}
+
+// connect looks up the handler registered for remote and, if found,
+// synchronously creates a pair of connected LocalConn and hands the
+// remote-side one to the handler in its own goroutine.
+func (lm *LocalManager) connect(local, remote Address) (*LocalConn, error) {
+	lm.Lock()
+	fn, ok := lm.listeners[remote]
+	lm.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("network: no listener at %s", remote)
+	}
+
+	here, there := newLocalConnPair(lm, local, remote)
+	go fn(there)
+	return here, nil
+}
+
+// pipeState is the state shared by both ends of a LocalConn pair, so that
+// closing either end is visible to the other.
+type pipeState struct {
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newPipeState() *pipeState {
+	return &pipeState{done: make(chan struct{})}
+}
+
+func (p *pipeState) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	close(p.done)
+	return nil
+}
+
+// LocalConn is an in-memory Conn: no real socket is involved, messages are
+// passed directly between the two ends through Go channels.
+type LocalConn struct {
+	local, remote Address
+	manager       *LocalManager
+	out           chan<- Packet
+	in            <-chan Packet
+	state         *pipeState
+	stats         *connStats
+}
+
+// newLocalConnPair creates two LocalConn that are connected to each other,
+// addrA/addrB being their respective local addresses.
+func newLocalConnPair(mgr *LocalManager, addrA, addrB Address) (*LocalConn, *LocalConn) {
+	aToB := make(chan Packet, 100)
+	bToA := make(chan Packet, 100)
+	state := newPipeState()
+
+	connA := &LocalConn{local: addrA, remote: addrB, manager: mgr, out: aToB, in: bToA, state: state, stats: newConnStats(addrA, addrB, "local")}
+	connB := &LocalConn{local: addrB, remote: addrA, manager: mgr, out: bToA, in: aToB, state: state, stats: newConnStats(addrB, addrA, "local")}
+	return connA, connB
+}
+
+// NewLocalConn dials remote using the default LocalManager. remote must
+// currently have a LocalListener listening on it.
+func NewLocalConn(local, remote Address) (Conn, error) {
+	return NewLocalConnWithManager(defaultLocalManager, local, remote)
+}
+
+// NewLocalConnWithManager is like NewLocalConn but uses the given manager,
+// so tests can run several independent local networks in parallel.
+func NewLocalConnWithManager(mgr *LocalManager, local, remote Address) (Conn, error) {
+	return mgr.connect(local, remote)
+}
+
+// Send implements the Conn interface. Delivery is routed through the
+// manager's fault injection (local_faults.go): depending on the configured
+// latency, bandwidth and loss rate for this link, the packet may be
+// delivered immediately, after a delay, or not at all.
+func (c *LocalConn) Send(ctx context.Context, msg interface{}) error {
+	select {
+	case <-c.state.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	id, err := packetTypeOf(msg)
+	if err != nil {
+		return err
+	}
+	packet := Packet{MsgType: id, Msg: underlyingValue(msg), From: c.local}
+	c.stats.recordSent(estimatePacketSize(packet))
+
+	return c.manager.faults.schedule(ctx, c.state, c.local, c.remote, packet, c.out)
+}
+
+// Receive implements the Conn interface.
+func (c *LocalConn) Receive(ctx context.Context) (Packet, error) {
+	select {
+	case p := <-c.in:
+		c.stats.recordReceived(estimatePacketSize(p))
+		return p, nil
+	case <-c.state.done:
+		return Packet{}, ErrClosed
+	case <-ctx.Done():
+		return Packet{}, ctx.Err()
+	}
+}
+
+// Close implements the Conn interface.
+func (c *LocalConn) Close() error {
+	c.stats.closed()
+	return c.state.close()
+}
+
+// connStats implements connStatsProvider, so diagnostics code can register
+// and read this conn's counters without LocalConn exposing them itself.
+func (c *LocalConn) connStats() *connStats {
+	return c.stats
+}
+
+// Local implements the Conn interface.
+func (c *LocalConn) Local() Address {
+	return c.local
+}
+
+// Remote implements the Conn interface.
+func (c *LocalConn) Remote() Address {
+	return c.remote
+}
+
+// LocalListener listens for LocalConn on a given Address.
+type LocalListener struct {
+	addr    Address
+	manager *LocalManager
+	stats   *connRegistry
+
+	mu        sync.Mutex
+	listening bool
+	quit      chan bool
+}
+
+// NewLocalListener creates a LocalListener on the default LocalManager.
+func NewLocalListener(addr Address) (*LocalListener, error) {
+	return NewLocalListenerWithManager(defaultLocalManager, addr)
+}
+
+// NewLocalListenerWithManager creates a LocalListener bound to the given
+// manager instead of the default one.
+func NewLocalListenerWithManager(mgr *LocalManager, addr Address) (*LocalListener, error) {
+	return &LocalListener{addr: addr, manager: mgr, stats: newConnRegistry()}, nil
+}
+
+// Listen implements the Listener interface: it blocks, calling fn for every
+// incoming LocalConn, until Stop is called.
+func (l *LocalListener) Listen(fn func(Conn)) error {
+	l.mu.Lock()
+	if l.listening {
+		l.mu.Unlock()
+		return fmt.Errorf("network: listener on %s is already listening", l.addr)
+	}
+	l.listening = true
+	l.quit = make(chan bool)
+	l.mu.Unlock()
+
+	if err := l.manager.register(l.addr, func(c Conn) {
+		if sp, ok := c.(connStatsProvider); ok {
+			l.stats.add(sp.connStats())
+		}
+		fn(c)
+	}); err != nil {
+		l.mu.Lock()
+		l.listening = false
+		l.mu.Unlock()
+		return err
+	}
+
+	<-l.quit
+	return nil
+}
+
+// Stats implements the Listener interface.
+func (l *LocalListener) Stats() ListenerStats {
+	return l.stats.stats()
+}
+
+// Addr returns the address this listener is bound to.
+func (l *LocalListener) Addr() Address {
+	return l.addr
+}
+
+// Stop implements the Listener interface.
+func (l *LocalListener) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.listening {
+		return fmt.Errorf("network: listener on %s is not listening", l.addr)
+	}
+	l.listening = false
+	l.manager.unregister(l.addr)
+	close(l.quit)
+	return nil
+}
+
+// LocalHost actively dials other LocalListener, retrying for a short while
+// in case the remote listener has not started yet.
+type LocalHost struct {
+	addr    Address
+	manager *LocalManager
+	stats   *connRegistry
+}
+
+// NewLocalHost creates a LocalHost on the default LocalManager.
+func NewLocalHost(addr Address) (*LocalHost, error) {
+	return NewLocalHostWithManager(defaultLocalManager, addr)
+}
+
+// NewLocalHostWithManager creates a LocalHost bound to the given manager.
+func NewLocalHostWithManager(mgr *LocalManager, addr Address) (*LocalHost, error) {
+	return &LocalHost{addr: addr, manager: mgr, stats: newConnRegistry()}, nil
+}
+
+const localHostMaxRetry = 20
+const localHostRetryWait = 20 * time.Millisecond
+
+// Connect implements the Host interface. It retries a few times since the
+// remote listener may not be registered with the manager yet.
+func (h *LocalHost) Connect(remote Address) (Conn, error) {
+	var err error
+	for i := 0; i < localHostMaxRetry; i++ {
+		var c Conn
+		c, err = NewLocalConnWithManager(h.manager, h.addr, remote)
+		if err == nil {
+			if sp, ok := c.(connStatsProvider); ok {
+				h.stats.add(sp.connStats())
+			}
+			return c, nil
+		}
+		time.Sleep(localHostRetryWait)
+	}
+	return nil, err
+}
+
+// Diagnose implements the Host interface.
+func (h *LocalHost) Diagnose(ctx context.Context) ([]*ConnInfo, error) {
+	return h.stats.snapshot(), nil
+}
+
+// DiagnoseNetwork returns this host's own Diagnose output and, for
+// depth > 0, that of every peer it is currently connected to, keyed by
+// address. Only direct peers appear in the result, whatever depth is:
+// entries a peer gathers from its own peers are not included.
+func (h *LocalHost) DiagnoseNetwork(ctx context.Context, depth int) (map[Address][]*ConnInfo, error) {
+	return diagnoseNetwork(ctx, h.addr, h, depth)
+}
@@ -0,0 +1,272 @@
+package network
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// pairKey identifies an unordered (from, to) link, so SetLatency(a, b, ...)
+// and SetLatency(b, a, ...) hit the same entry.
+type pairKey struct{ a, b Address }
+
+func mkPairKey(a, b Address) pairKey {
+	if a > b {
+		a, b = b, a
+	}
+	return pairKey{a, b}
+}
+
+type latencySpec struct {
+	mean, jitter time.Duration
+}
+
+// delivery is one packet waiting for the manager's virtual clock to reach
+// deliverAt; see faultState.queue.
+type delivery struct {
+	deliverAt time.Duration
+	out       chan<- Packet
+	packet    Packet
+	index     int
+}
+
+type deliveryQueue []*delivery
+
+func (q deliveryQueue) Len() int           { return len(q) }
+func (q deliveryQueue) Less(i, j int) bool { return q[i].deliverAt < q[j].deliverAt }
+func (q deliveryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *deliveryQueue) Push(x interface{}) {
+	d := x.(*delivery)
+	d.index = len(*q)
+	*q = append(*q, d)
+}
+
+func (q *deliveryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	d := old[n-1]
+	*q = old[:n-1]
+	return d
+}
+
+// faultState holds every LocalManager's fault-injection configuration and,
+// once AdvanceTime has been used at least once, the virtual-clock delivery
+// queue driving it.
+type faultState struct {
+	sync.Mutex
+	latencies   map[pairKey]latencySpec
+	partitioned map[pairKey]bool
+	lossRate    float64
+
+	bandwidth  int // bytes/sec; 0 means unlimited
+	tokens     float64
+	lastRefill time.Time
+
+	virtual    bool
+	virtualNow time.Duration
+	queue      deliveryQueue
+}
+
+func newFaultState() *faultState {
+	return &faultState{
+		latencies:   make(map[pairKey]latencySpec),
+		partitioned: make(map[pairKey]bool),
+	}
+}
+
+// SetLatency configures the simulated one-way latency between from and to
+// (applied symmetrically) as mean +/- up to jitter, applied to every
+// Send from either address to the other.
+func (lm *LocalManager) SetLatency(from, to Address, mean, jitter time.Duration) {
+	fs := lm.faults
+	fs.Lock()
+	defer fs.Unlock()
+	fs.latencies[mkPairKey(from, to)] = latencySpec{mean: mean, jitter: jitter}
+}
+
+// SetBandwidth caps this manager's simulated throughput at bps bytes/sec,
+// enforced with a token bucket shared by every link: a Send that would
+// exceed it is delayed rather than dropped.
+func (lm *LocalManager) SetBandwidth(bps int) {
+	fs := lm.faults
+	fs.Lock()
+	defer fs.Unlock()
+	fs.bandwidth = bps
+	fs.tokens = float64(bps)
+	fs.lastRefill = time.Now()
+}
+
+// SetLossRate makes a fraction p (0..1) of packets sent on this manager
+// vanish instead of being delivered.
+func (lm *LocalManager) SetLossRate(p float64) {
+	fs := lm.faults
+	fs.Lock()
+	defer fs.Unlock()
+	fs.lossRate = p
+}
+
+// Partition makes every pair of addresses in addrs mutually unreachable:
+// Send between any two of them is silently dropped until Heal is called
+// with (at least) the same pair.
+func (lm *LocalManager) Partition(addrs ...Address) {
+	fs := lm.faults
+	fs.Lock()
+	defer fs.Unlock()
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			fs.partitioned[mkPairKey(addrs[i], addrs[j])] = true
+		}
+	}
+}
+
+// Heal reverses a prior Partition call for every pair of addresses in
+// addrs.
+func (lm *LocalManager) Heal(addrs ...Address) {
+	fs := lm.faults
+	fs.Lock()
+	defer fs.Unlock()
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			delete(fs.partitioned, mkPairKey(addrs[i], addrs[j]))
+		}
+	}
+}
+
+// AdvanceTime moves the manager's virtual clock forward by d and delivers,
+// in order, every packet whose simulated delay has now elapsed. Calling it
+// switches the manager from real-time delay scheduling (via time.AfterFunc)
+// to virtual-time scheduling, making latency/jitter tests reproducible
+// instead of depending on wall-clock scheduling.
+func (lm *LocalManager) AdvanceTime(d time.Duration) {
+	fs := lm.faults
+
+	fs.Lock()
+	fs.virtual = true
+	fs.virtualNow += d
+	var ready []*delivery
+	for fs.queue.Len() > 0 && fs.queue[0].deliverAt <= fs.virtualNow {
+		ready = append(ready, heap.Pop(&fs.queue).(*delivery))
+	}
+	fs.Unlock()
+
+	for _, d := range ready {
+		d.out <- d.packet
+	}
+}
+
+// schedule decides whether p should reach out at all (Partition, loss
+// rate) and, if so, when: right away, after a simulated link delay, or (in
+// virtual-clock mode) at a virtual deadline that AdvanceTime will later
+// cross. It only blocks the caller for the no-delay fast path, so that
+// Send's ctx and close semantics still apply there.
+func (fs *faultState) schedule(ctx context.Context, state *pipeState, from, to Address, p Packet, out chan<- Packet) error {
+	fs.Lock()
+	if fs.dropped(from, to) {
+		fs.Unlock()
+		return nil
+	}
+
+	delay := fs.latencyFor(from, to) + fs.consumeTokens(estimatePacketSize(p))
+	virtual := fs.virtual
+	deliverAt := fs.virtualNow + delay
+	fs.Unlock()
+
+	switch {
+	case virtual:
+		fs.Lock()
+		heap.Push(&fs.queue, &delivery{deliverAt: deliverAt, out: out, packet: p})
+		fs.Unlock()
+		return nil
+
+	case delay <= 0:
+		select {
+		case out <- p:
+			return nil
+		case <-state.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+	default:
+		time.AfterFunc(delay, func() {
+			select {
+			case out <- p:
+			case <-state.done:
+			}
+		})
+		return nil
+	}
+}
+
+// dropped reports whether a send from -> to should vanish instead of being
+// delivered, due to a Partition or the configured loss rate. It must be
+// called with fs locked; packet.go's sendPacketTo uses it directly since
+// PacketConn sends skip schedule's latency/bandwidth accounting.
+func (fs *faultState) dropped(from, to Address) bool {
+	if fs.partitioned[mkPairKey(from, to)] {
+		return true
+	}
+	return fs.lossRate > 0 && rand.Float64() < fs.lossRate
+}
+
+// latencyFor must be called with fs locked.
+func (fs *faultState) latencyFor(from, to Address) time.Duration {
+	spec, ok := fs.latencies[mkPairKey(from, to)]
+	if !ok || spec.jitter <= 0 {
+		return spec.mean
+	}
+	delta := time.Duration(rand.Int63n(int64(2*spec.jitter+1))) - spec.jitter
+	if d := spec.mean + delta; d > 0 {
+		return d
+	}
+	return 0
+}
+
+// consumeTokens must be called with fs locked. It returns how long the
+// caller must wait, given the current token bucket, before size bytes'
+// worth of bandwidth is available, consuming that bandwidth in the
+// process.
+func (fs *faultState) consumeTokens(size int) time.Duration {
+	if fs.bandwidth <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if fs.lastRefill.IsZero() {
+		fs.lastRefill = now
+		fs.tokens = float64(fs.bandwidth)
+	}
+	fs.tokens += now.Sub(fs.lastRefill).Seconds() * float64(fs.bandwidth)
+	if fs.tokens > float64(fs.bandwidth) {
+		fs.tokens = float64(fs.bandwidth)
+	}
+	fs.lastRefill = now
+
+	// The bucket may go negative: a send that finds too few tokens borrows
+	// against future refills, so back-to-back sends queue up behind each
+	// other instead of all waiting the same amount.
+	fs.tokens -= float64(size)
+	if fs.tokens >= 0 {
+		return 0
+	}
+	wait := -fs.tokens / float64(fs.bandwidth)
+	return time.Duration(wait * float64(time.Second))
+}
+
+// estimatePacketSize is how big p would be on the wire, used only to cost
+// it against the bandwidth token bucket.
+func estimatePacketSize(p Packet) int {
+	b, err := gobEncode(p.MsgType, p.Msg)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
@@ -2,8 +2,6 @@ package network
 
 import (
 	"fmt"
-	"strconv"
-	"sync"
 	"testing"
 	"time"
 
@@ -12,68 +10,8 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestLocalListener(t *testing.T) {
-	addr := NewLocalAddress("127.0.0.1:2000")
-	listener, err := NewLocalListener(addr)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	var ready = make(chan bool)
-	go func() {
-		ready <- true
-		err := listener.Listen(func(c Conn) {})
-		if err != nil {
-			t.Error("Should not have had error while listening")
-		}
-		ready <- true
-	}()
-
-	<-ready
-	// give it some time
-	time.Sleep(20 * time.Millisecond)
-	if err := listener.Listen(func(c Conn) {}); err == nil {
-		t.Error("listener should have returned an error when Listen twice")
-	}
-	assert.Nil(t, listener.Stop())
-	if err := listener.Stop(); err == nil {
-		t.Error("listener.Stop() twice should have returned an error")
-	}
-	<-ready
-}
-
-// Test whether a call to a conn.Close() will stop the remote Receive() call
-func TestLocalConnCloseReceive(t *testing.T) {
-	addr := NewLocalAddress("127.0.0.1:2000")
-	listener, err := NewLocalListener(addr)
-	if err != nil {
-		t.Fatal("Could not listen", err)
-	}
-
-	var ready = make(chan bool)
-	go func() {
-		ready <- true
-		listener.Listen(func(c Conn) {
-			ready <- true
-			assert.Nil(t, c.Close())
-		})
-	}()
-	<-ready
-
-	outgoing, err := NewLocalConn(addr, addr)
-	if err != nil {
-		t.Fatal("erro NewLocalConn:", err)
-	}
-	<-ready
-
-	_, err = outgoing.Receive(context.TODO())
-	assert.Equal(t, ErrClosed, err)
-	assert.Equal(t, ErrClosed, outgoing.Close())
-	assert.Nil(t, listener.Stop())
-
-}
-
-// Test if we can run two parallel local network using two different contexts
+// Test whether two independent LocalManager behave as two separate
+// networks, even when addresses overlap between them.
 func TestLocalContext(t *testing.T) {
 	ctx1 := NewLocalManager()
 	ctx2 := NewLocalManager()
@@ -183,134 +121,39 @@ func testConnListener(ctx *LocalManager, done chan error, listenA, connA Address
 	done <- nil
 }
 
-func TestLocalConnDiffAddress(t *testing.T) {
-	testLocalConn(t, NewLocalAddress("127.0.0.1:2000"), NewLocalAddress("127.0.0.1:2001"))
-}
-
-func TestLocalConnSameAddress(t *testing.T) {
-	testLocalConn(t, NewLocalAddress("127.0.0.1:2000"), NewLocalAddress("127.0.0.1:2000"))
+type AddressTest struct {
+	Addr Address
+	Val  int
 }
 
-func testLocalConn(t *testing.T, a1, a2 Address) {
-	addr1 := a1
-	addr2 := a2
+var AddressTestType = RegisterPacketType(&AddressTest{})
 
-	listener, err := NewLocalListener(addr1)
+func TestLocalListener(t *testing.T) {
+	addr := NewLocalAddress("127.0.0.1:2010")
+	listener, err := NewLocalListener(addr)
 	if err != nil {
-		t.Fatal("Could not listen", err)
+		t.Fatal(err)
 	}
 
 	var ready = make(chan bool)
-	var incomingConn = make(chan bool)
-	var outgoingConn = make(chan bool)
 	go func() {
 		ready <- true
-		listener.Listen(func(c Conn) {
-			incomingConn <- true
-			nm, err := c.Receive(context.TODO())
-			assert.Nil(t, err)
-			assert.Equal(t, 3, nm.Msg.(SimpleMessage).I)
-			// acknoledge the message
-			incomingConn <- true
-			err = c.Send(context.TODO(), &SimpleMessage{3})
-			assert.Nil(t, err)
-			//wait ack
-			<-outgoingConn
-			// close connection
-			assert.Nil(t, c.Close())
-		})
+		err := listener.Listen(func(c Conn) {})
+		if err != nil {
+			t.Error("Should not have had error while listening")
+		}
 		ready <- true
 	}()
-	<-ready
-
-	outgoing, err := NewLocalConn(addr2, addr1)
-	if err != nil {
-		t.Fatal("erro NewLocalConn:", err)
-	}
 
-	// check if connection is opened on the listener
-	<-incomingConn
-	// send stg and wait for ack
-	assert.Nil(t, outgoing.Send(context.TODO(), &SimpleMessage{3}))
-	<-incomingConn
-
-	// receive stg and send ack
-	nm, err := outgoing.Receive(context.TODO())
-	assert.Nil(t, err)
-	assert.Equal(t, 3, nm.Msg.(SimpleMessage).I)
-	outgoingConn <- true
-
-	// close the incoming conn, so Receive here should return an error
-	nm, err = outgoing.Receive(context.TODO())
-	if err != ErrClosed {
-		t.Error("Receive should have returned an error")
-	}
-	assert.Equal(t, ErrClosed, outgoing.Close())
-
-	// close the listener
-	assert.Nil(t, listener.Stop())
 	<-ready
-}
-
-func TestLocalManyConn(t *testing.T) {
-	nbrConn := 3
-	addr := NewLocalAddress("127.0.0.1:2000")
-	listener, err := NewLocalListener(addr)
-	if err != nil {
-		t.Fatal("Could not setup listener:", err)
-	}
-	var wg sync.WaitGroup
-	go func() {
-		listener.Listen(func(c Conn) {
-			_, err := c.Receive(context.TODO())
-			assert.Nil(t, err)
-
-			assert.Nil(t, c.Send(context.TODO(), &SimpleMessage{3}))
-		})
-	}()
-
-	if !waitListeningUp(addr) {
-		t.Fatal("Can't get listener up")
-	}
-	wg.Add(nbrConn)
-	for i := 1; i <= nbrConn; i++ {
-		go func(j int) {
-			a := NewLocalAddress("127.0.0.1:" + strconv.Itoa(2000+j))
-			c, err := NewLocalConn(a, addr)
-			if err != nil {
-				t.Fatal(err)
-			}
-			assert.Nil(t, c.Send(context.TODO(), &SimpleMessage{3}))
-			nm, err := c.Receive(context.TODO())
-			assert.Nil(t, err)
-			assert.Equal(t, 3, nm.Msg.(SimpleMessage).I)
-			assert.Nil(t, c.Close())
-			wg.Done()
-		}(i)
+	// give it some time
+	time.Sleep(20 * time.Millisecond)
+	if err := listener.Listen(func(c Conn) {}); err == nil {
+		t.Error("listener should have returned an error when Listen twice")
 	}
-
-	wg.Wait()
-	listener.Stop()
-}
-
-func waitListeningUp(addr Address) bool {
-	for i := 0; i < 5; i++ {
-		if defaultLocalManager.isListening(addr) {
-			return true
-		}
-		time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, listener.Stop())
+	if err := listener.Stop(); err == nil {
+		t.Error("listener.Stop() twice should have returned an error")
 	}
-	return false
-}
-
-func NewTestLocalHost(port int) (*LocalHost, error) {
-	addr := NewLocalAddress("127.0.0.1:" + strconv.Itoa(port))
-	return NewLocalHost(addr)
-}
-
-type AddressTest struct {
-	Addr Address
-	Val  int
+	<-ready
 }
-
-var AddressTestType = RegisterPacketType(&AddressTest{})
@@ -0,0 +1,358 @@
+package network
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// ProtocolID identifies a subprotocol negotiated over a multiplexed Peer.
+// It is assigned per-session by negotiate, from the sorted list of shared
+// protocol names, so both ends agree on it without exchanging it
+// explicitly; look it up with Peer.Protocol rather than hard-coding one.
+type ProtocolID uint16
+
+// ErrNoCommonProtocol is returned by MuxHost.Connect, and causes a
+// MuxHost-wrapped Listener to silently drop the connection, when the two
+// peers' capability exchange has no (name, version) pair in common.
+var ErrNoCommonProtocol = errors.New("network: no common subprotocol")
+
+// protoSpec is one (name, version) capability a host advertises during the
+// capability exchange that precedes multiplexing.
+type protoSpec struct {
+	Name    string
+	Version uint
+}
+
+// capabilityMsg lists the subprotocols a host supports. It is the first
+// message exchanged on a Conn handed to MuxHost.
+type capabilityMsg struct {
+	Protocols []protoSpec
+}
+
+var capabilityMsgType = RegisterPacketType(&capabilityMsg{})
+
+// muxFrame carries one application message for one subprotocol over the
+// Conn shared by all of a Peer's subprotocols.
+type muxFrame struct {
+	Protocol ProtocolID
+	MsgType  PacketTypeID
+	Msg      interface{}
+}
+
+var muxFrameType = RegisterPacketType(&muxFrame{})
+
+// muxProto is what RegisterProtocol records for one subprotocol.
+type muxProto struct {
+	version uint
+	handler func(*Peer, MsgReader)
+}
+
+// MsgReader lets a subprotocol handler pull the next message addressed to
+// it on a Peer, the multiplexed equivalent of Conn.Receive.
+type MsgReader interface {
+	ReadMsg(ctx context.Context) (Packet, error)
+}
+
+// MuxHost lets several named subprotocols share a single underlying Conn
+// (dialed through host, or accepted through a MuxHost-wrapped Listener) by
+// running a capability exchange up front and then demultiplexing frames by
+// ProtocolID.
+type MuxHost struct {
+	host Host
+
+	mu     sync.Mutex
+	protos map[string]*muxProto
+}
+
+// NewMuxHost wraps host so RegisterProtocol'd subprotocols can share the
+// connections it dials.
+func NewMuxHost(host Host) *MuxHost {
+	return &MuxHost{host: host, protos: make(map[string]*muxProto)}
+}
+
+// RegisterProtocol declares a subprotocol this host supports. handler is
+// started in its own goroutine for every Peer (dialed via Connect or
+// accepted via a MuxHost-wrapped Listener) whose capability exchange
+// included (name, version).
+func (h *MuxHost) RegisterProtocol(name string, version uint, handler func(*Peer, MsgReader)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.protos[name] = &muxProto{version: version, handler: handler}
+}
+
+// Connect dials remote, negotiates the shared subprotocols and returns the
+// resulting Peer. If dial or negotiation fails (including
+// ErrNoCommonProtocol) the underlying Conn is closed.
+func (h *MuxHost) Connect(remote Address) (*Peer, error) {
+	conn, err := h.host.Connect(remote)
+	if err != nil {
+		return nil, err
+	}
+	return h.negotiate(conn, true)
+}
+
+// Listen wraps inner so every accepted Conn first goes through the same
+// capability exchange as Connect. Connections with no common subprotocol
+// are closed and never reach fn. fn still receives the raw negotiated Conn,
+// for callers that want to layer more on top of it.
+func (h *MuxHost) Listen(inner Listener) Listener {
+	return &muxListener{inner: inner, host: h}
+}
+
+type muxListener struct {
+	inner Listener
+	host  *MuxHost
+}
+
+func (l *muxListener) Listen(fn func(Conn)) error {
+	return l.inner.Listen(func(c Conn) {
+		peer, err := l.host.negotiate(c, false)
+		if err != nil {
+			return
+		}
+		fn(peer.conn)
+	})
+}
+
+func (l *muxListener) Stop() error {
+	return l.inner.Stop()
+}
+
+// Stats implements the Listener interface.
+func (l *muxListener) Stats() ListenerStats {
+	return l.inner.Stats()
+}
+
+// negotiate runs the capability exchange over conn (initiator sends
+// first), computes the intersection with the locally registered protocols,
+// and spawns a handler goroutine per shared subprotocol.
+func (h *MuxHost) negotiate(conn Conn, initiator bool) (*Peer, error) {
+	ctx := context.Background()
+	mine := h.specs()
+
+	var remote capabilityMsg
+	if initiator {
+		if err := conn.Send(ctx, &capabilityMsg{Protocols: mine}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		p, err := conn.Receive(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cm, ok := p.Msg.(capabilityMsg)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("network: expected capability message")
+		}
+		remote = cm
+	} else {
+		p, err := conn.Receive(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cm, ok := p.Msg.(capabilityMsg)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("network: expected capability message")
+		}
+		remote = cm
+		if err := conn.Send(ctx, &capabilityMsg{Protocols: mine}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	shared := h.intersect(remote.Protocols)
+	if len(shared) == 0 {
+		conn.Close()
+		return nil, ErrNoCommonProtocol
+	}
+	// Both ends compute `shared` from the same (sorted) set of names, so
+	// assigning ids by sorted position gives both sides the same
+	// name->ProtocolID mapping without having to exchange it.
+	sort.Strings(shared)
+
+	peer := newPeer(conn)
+	for i, name := range shared {
+		id := ProtocolID(i + 1)
+		peer.protocolIDs[name] = id
+
+		h.mu.Lock()
+		proto := h.protos[name]
+		h.mu.Unlock()
+		go proto.handler(peer, peer.reader(id))
+	}
+	return peer, nil
+}
+
+func (h *MuxHost) specs() []protoSpec {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	specs := make([]protoSpec, 0, len(h.protos))
+	for name, p := range h.protos {
+		specs = append(specs, protoSpec{Name: name, Version: p.version})
+	}
+	return specs
+}
+
+func (h *MuxHost) intersect(remote []protoSpec) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var shared []string
+	for _, r := range remote {
+		if p, ok := h.protos[r.Name]; ok && p.version == r.Version {
+			shared = append(shared, r.Name)
+		}
+	}
+	return shared
+}
+
+// Peer is an established, capability-negotiated connection to a remote
+// host. Subprotocol handlers talk to it through the MsgReader they were
+// started with, plus OpenStream to send.
+type Peer struct {
+	conn Conn
+
+	// protocolIDs maps a negotiated subprotocol's name to the ProtocolID
+	// this session agreed on for it (see negotiate); it never changes
+	// after the Peer is created, so it needs no locking.
+	protocolIDs map[string]ProtocolID
+
+	mu      sync.Mutex
+	streams map[ProtocolID]chan Packet
+	started bool
+	closed  chan struct{}
+}
+
+func newPeer(conn Conn) *Peer {
+	return &Peer{
+		conn:        conn,
+		protocolIDs: make(map[string]ProtocolID),
+		streams:     make(map[ProtocolID]chan Packet),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Remote returns the address of the peer at the other end of the Conn.
+func (p *Peer) Remote() Address {
+	return p.conn.Remote()
+}
+
+// Protocol returns the ProtocolID this session negotiated for the named
+// subprotocol, for use with OpenStream. ok is false if name was not part
+// of the negotiated intersection.
+func (p *Peer) Protocol(name string) (id ProtocolID, ok bool) {
+	id, ok = p.protocolIDs[name]
+	return id, ok
+}
+
+// OpenStream returns a Conn-like handle scoped to proto: Send tags every
+// message with proto's id, Receive only ever returns messages the demux
+// loop routed to proto.
+func (p *Peer) OpenStream(proto ProtocolID) Conn {
+	return &muxStream{peer: p, proto: proto}
+}
+
+// reader returns (creating if necessary) the MsgReader proto's handler
+// reads from, starting the shared demux loop on first use.
+func (p *Peer) reader(proto ProtocolID) MsgReader {
+	return &peerReader{peer: p, ch: p.channelFor(proto)}
+}
+
+func (p *Peer) channelFor(proto ProtocolID) chan Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, ok := p.streams[proto]
+	if !ok {
+		ch = make(chan Packet, 16)
+		p.streams[proto] = ch
+	}
+	if !p.started {
+		p.started = true
+		go p.demux()
+	}
+	return ch
+}
+
+// demux reads muxFrame off the shared Conn and routes each one to the
+// channel registered for its protocol, dropping frames for protocols
+// nobody asked for.
+func (p *Peer) demux() {
+	for {
+		pkt, err := p.conn.Receive(context.Background())
+		if err != nil {
+			close(p.closed)
+			return
+		}
+		mf, ok := pkt.Msg.(muxFrame)
+		if !ok {
+			continue
+		}
+
+		p.mu.Lock()
+		ch, ok := p.streams[mf.Protocol]
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		select {
+		case ch <- Packet{MsgType: mf.MsgType, Msg: mf.Msg, From: p.conn.Remote()}:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+type peerReader struct {
+	peer *Peer
+	ch   chan Packet
+}
+
+func (r *peerReader) ReadMsg(ctx context.Context) (Packet, error) {
+	select {
+	case pkt := <-r.ch:
+		return pkt, nil
+	case <-r.peer.closed:
+		return Packet{}, ErrClosed
+	case <-ctx.Done():
+		return Packet{}, ctx.Err()
+	}
+}
+
+// muxStream is the Conn-like object OpenStream hands to callers that want
+// to send on, and optionally also receive from, a single subprotocol.
+type muxStream struct {
+	peer  *Peer
+	proto ProtocolID
+}
+
+func (s *muxStream) Send(ctx context.Context, msg interface{}) error {
+	id, err := packetTypeOf(msg)
+	if err != nil {
+		return err
+	}
+	return s.peer.conn.Send(ctx, &muxFrame{Protocol: s.proto, MsgType: id, Msg: underlyingValue(msg)})
+}
+
+func (s *muxStream) Receive(ctx context.Context) (Packet, error) {
+	return s.peer.reader(s.proto).ReadMsg(ctx)
+}
+
+func (s *muxStream) Close() error {
+	return s.peer.conn.Close()
+}
+
+func (s *muxStream) Local() Address {
+	return s.peer.conn.Local()
+}
+
+func (s *muxStream) Remote() Address {
+	return s.peer.conn.Remote()
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxHostNegotiation(t *testing.T) {
+	addr := nextAddr()
+	listener, err := NewLocalListener(addr)
+	assert.Nil(t, err)
+
+	serverHost := NewMuxHost(nil)
+	received := make(chan SimpleMessage, 1)
+	serverHost.RegisterProtocol("randomness", 1, func(p *Peer, r MsgReader) {
+		pkt, err := r.ReadMsg(context.TODO())
+		assert.Nil(t, err)
+		received <- pkt.Msg.(SimpleMessage)
+	})
+	muxListener := serverHost.Listen(listener)
+
+	go muxListener.Listen(func(c Conn) {})
+	if !waitListening(defaultLocalManager, addr) {
+		t.Fatal("listener never came up")
+	}
+
+	clientHost := NewMuxHost(&localDialer{})
+	clientHost.RegisterProtocol("randomness", 1, func(p *Peer, r MsgReader) {})
+
+	peer, err := clientHost.Connect(addr)
+	assert.Nil(t, err)
+
+	id, ok := peer.Protocol("randomness")
+	assert.True(t, ok)
+	stream := peer.OpenStream(id)
+	assert.Nil(t, stream.Send(context.TODO(), &SimpleMessage{7}))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, SimpleMessage{7}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("server never received the message")
+	}
+
+	muxListener.Stop()
+}
+
+func TestMuxHostNoCommonProtocol(t *testing.T) {
+	addr := nextAddr()
+	listener, err := NewLocalListener(addr)
+	assert.Nil(t, err)
+
+	serverHost := NewMuxHost(nil)
+	serverHost.RegisterProtocol("sync", 1, func(p *Peer, r MsgReader) {})
+	muxListener := serverHost.Listen(listener)
+
+	go muxListener.Listen(func(c Conn) {})
+	if !waitListening(defaultLocalManager, addr) {
+		t.Fatal("listener never came up")
+	}
+
+	clientHost := NewMuxHost(&localDialer{})
+	clientHost.RegisterProtocol("randomness", 1, func(p *Peer, r MsgReader) {})
+
+	_, err = clientHost.Connect(addr)
+	assert.Equal(t, ErrNoCommonProtocol, err)
+
+	muxListener.Stop()
+}
+
+// localDialer is a minimal Host that dials out over the local in-memory
+// transport, used to drive MuxHost.Connect in tests.
+type localDialer struct{}
+
+func (d *localDialer) Connect(remote Address) (Conn, error) {
+	h, err := NewLocalHost(nextAddr())
+	if err != nil {
+		return nil, err
+	}
+	return h.Connect(remote)
+}
+
+// Diagnose implements the Host interface.
+func (d *localDialer) Diagnose(ctx context.Context) ([]*ConnInfo, error) {
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+// Package network provides the transport abstractions used by the
+// randomness protocol: Address, Conn, Listener and Host. Multiple
+// transports can implement these interfaces (see local.go for an in-memory
+// backend and tcp.go for a real TCP one) so the protocol code never has to
+// know which one it is running over.
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Address identifies a host on the network, e.g. "127.0.0.1:2000".
+type Address string
+
+// NewLocalAddress returns an Address to be used with the local in-memory
+// transport.
+func NewLocalAddress(addr string) Address {
+	return Address(addr)
+}
+
+// NetworkAddress returns the string representation of the address.
+func (a Address) NetworkAddress() string {
+	return string(a)
+}
+
+func (a Address) String() string {
+	return string(a)
+}
+
+// Conn represents a bidirectional, registered-type-only connection to a
+// remote peer.
+type Conn interface {
+	// Send encodes and sends msg to the remote peer. msg's type must have
+	// been registered with RegisterPacketType beforehand.
+	Send(ctx context.Context, msg interface{}) error
+	// Receive blocks until a Packet arrives, ctx is done, or the
+	// connection is closed, in which case it returns ErrClosed.
+	Receive(ctx context.Context) (Packet, error)
+	// Close closes the connection. Calling Close on an already-closed
+	// connection (by either side) returns ErrClosed.
+	Close() error
+	// Local returns the local address of this connection.
+	Local() Address
+	// Remote returns the remote address of this connection.
+	Remote() Address
+}
+
+// Listener accepts incoming connections on a given Address and dispatches
+// each one to the handler passed to Listen.
+type Listener interface {
+	// Listen blocks, calling fn for every incoming connection, until Stop
+	// is called.
+	Listen(fn func(Conn)) error
+	// Stop makes a blocked Listen call return. Calling Stop twice returns
+	// an error.
+	Stop() error
+	// Stats returns cumulative accept counts, the current number of open
+	// connections, and how many of them came from each remote address.
+	Stats() ListenerStats
+}
+
+// Host can actively dial out to other addresses.
+type Host interface {
+	// Connect dials the given remote address and returns an established
+	// Conn.
+	Connect(remote Address) (Conn, error)
+	// Diagnose returns the set of connections currently open on this
+	// host, with their traffic counters and timestamps.
+	Diagnose(ctx context.Context) ([]*ConnInfo, error)
+}
+
+// ErrClosed is returned by Conn methods once the connection has been
+// closed, from either end.
+var ErrClosed = errors.New("network: connection closed")
+
+// PacketTypeID uniquely identifies a registered message type.
+type PacketTypeID uint32
+
+// ErrorType is reserved and is never returned by RegisterPacketType.
+const ErrorType PacketTypeID = 0
+
+// Packet is what Conn.Receive returns: the decoded message, its type and
+// the address it came from.
+type Packet struct {
+	MsgType PacketTypeID
+	Msg     interface{}
+	From    Address
+}
+
+var typeRegistry = struct {
+	sync.Mutex
+	toType map[PacketTypeID]reflect.Type
+	toID   map[reflect.Type]PacketTypeID
+	nextID PacketTypeID
+}{
+	toType: make(map[PacketTypeID]reflect.Type),
+	toID:   make(map[reflect.Type]PacketTypeID),
+	nextID: ErrorType + 1,
+}
+
+// RegisterPacketType registers msg's type so it can cross Conn.Send /
+// Conn.Receive. It is idempotent: registering the same type twice returns
+// the same PacketTypeID. It should be called at init time, as package-level
+// variables, for every message type a protocol needs to exchange.
+func RegisterPacketType(msg interface{}) PacketTypeID {
+	t := underlyingType(msg)
+
+	typeRegistry.Lock()
+	defer typeRegistry.Unlock()
+	if id, ok := typeRegistry.toID[t]; ok {
+		return id
+	}
+	id := typeRegistry.nextID
+	typeRegistry.nextID++
+	typeRegistry.toID[t] = id
+	typeRegistry.toType[id] = t
+
+	// Transports that encode frames with gob (e.g. TCPConn) need the
+	// concrete type registered under a stable name.
+	gob.RegisterName(t.PkgPath()+"."+t.Name(), reflect.New(t).Elem().Interface())
+	return id
+}
+
+// packetTypeOf returns the PacketTypeID registered for msg's type, or an
+// error if it was never registered.
+func packetTypeOf(msg interface{}) (PacketTypeID, error) {
+	t := underlyingType(msg)
+	typeRegistry.Lock()
+	defer typeRegistry.Unlock()
+	id, ok := typeRegistry.toID[t]
+	if !ok {
+		return ErrorType, fmt.Errorf("network: type %s not registered, call RegisterPacketType first", t)
+	}
+	return id, nil
+}
+
+func underlyingType(msg interface{}) reflect.Type {
+	return reflect.Indirect(reflect.ValueOf(msg)).Type()
+}
+
+// underlyingValue dereferences msg if it is a pointer, so Packet.Msg always
+// holds a value, never a pointer, regardless of how Send was called.
+func underlyingValue(msg interface{}) interface{} {
+	return reflect.Indirect(reflect.ValueOf(msg)).Interface()
+}
+
+// wireFrame is the (type, value) pair that transports needing to serialize
+// a Packet onto the wire (TCPConn, SecureConn) gob-encode. Msg relies on
+// its concrete type having been registered with gob by RegisterPacketType.
+type wireFrame struct {
+	Type PacketTypeID
+	Msg  interface{}
+}
+
+// gobEncode gob-encodes id and msg as a wireFrame.
+func gobEncode(id PacketTypeID, msg interface{}) ([]byte, error) {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(wireFrame{Type: id, Msg: msg}); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// gobDecode decodes a wireFrame previously produced by gobEncode.
+func gobDecode(body []byte) (PacketTypeID, interface{}, error) {
+	var frame wireFrame
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&frame); err != nil {
+		return ErrorType, nil, err
+	}
+	return frame.Type, frame.Msg, nil
+}
+
+// SimpleMessage is a minimal message used in tests to exercise Send/Receive.
+type SimpleMessage struct {
+	I int
+}
+
+// SimpleMessageType is the PacketTypeID of SimpleMessage.
+var SimpleMessageType = RegisterPacketType(&SimpleMessage{})
@@ -0,0 +1,314 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// packetDeadlineStep is how often ReadFrom re-checks ctx.Done() while
+// waiting on the underlying socket, by pushing a short read deadline; see
+// tcpDeadlineStep for the stream-Conn equivalent.
+const packetDeadlineStep = 100 * time.Millisecond
+
+// defaultPacketMTU caps a PacketConn payload when none is given explicitly;
+// it is comfortably under the ~1500-byte Ethernet MTU once IP/UDP headers
+// are accounted for, so a datagram this size is unlikely to fragment.
+const defaultPacketMTU = 1200
+
+// ErrMessageTooLarge is returned by PacketConn.WriteTo when msg's encoded
+// size exceeds the conn's configured MTU.
+var ErrMessageTooLarge = errors.New("network: message exceeds configured MTU")
+
+// Envelope is what PacketConn.ReadFrom returns: a decoded message, its
+// registered type, and the address it arrived from.
+type Envelope struct {
+	MsgType PacketTypeID
+	Msg     interface{}
+	From    Address
+}
+
+// PacketConn is the connectionless peer to Conn: instead of a persistent
+// stream to a single remote, WriteTo addresses every message individually
+// and ReadFrom returns whichever arrives next, from anyone. It suits
+// protocols that only need best-effort broadcast (e.g. beacon gossip in
+// the randomness protocol) and would rather skip per-peer connection setup
+// entirely.
+type PacketConn interface {
+	// WriteTo encodes and sends msg to dst. msg's type must have been
+	// registered with RegisterPacketType beforehand, and its encoded size
+	// must fit within the conn's MTU or ErrMessageTooLarge is returned.
+	WriteTo(ctx context.Context, msg interface{}, dst Address) error
+	// ReadFrom blocks until a datagram arrives, ctx is done, or the conn
+	// is closed, in which case it returns ErrClosed.
+	ReadFrom(ctx context.Context) (Envelope, error)
+	// Close closes the conn. Calling Close on an already-closed conn
+	// returns ErrClosed.
+	Close() error
+	// Local returns the local address of this conn.
+	Local() Address
+}
+
+// LocalPacketConn is an in-memory PacketConn: it reuses a LocalManager's
+// address registry to route datagrams to another LocalPacketConn, without
+// touching a real socket, mirroring LocalConn's relationship to TCPConn.
+type LocalPacketConn struct {
+	addr    Address
+	manager *LocalManager
+	mtu     int
+	in      chan Envelope
+	done    chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewLocalPacketConn creates a LocalPacketConn on the default LocalManager,
+// with the default MTU.
+func NewLocalPacketConn(addr Address) (*LocalPacketConn, error) {
+	return NewLocalPacketConnWithManager(defaultLocalManager, addr, defaultPacketMTU)
+}
+
+// NewLocalPacketConnWithManager is like NewLocalPacketConn but binds to the
+// given manager and MTU, so tests can run independent local networks, or
+// exercise ErrMessageTooLarge, without touching the default manager.
+func NewLocalPacketConnWithManager(mgr *LocalManager, addr Address, mtu int) (*LocalPacketConn, error) {
+	c := &LocalPacketConn{addr: addr, manager: mgr, mtu: mtu, in: make(chan Envelope, 100), done: make(chan struct{})}
+	if err := mgr.registerPacketConn(addr, c.in); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WriteTo implements the PacketConn interface.
+func (c *LocalPacketConn) WriteTo(ctx context.Context, msg interface{}, dst Address) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	id, err := packetTypeOf(msg)
+	if err != nil {
+		return err
+	}
+	value := underlyingValue(msg)
+	body, err := gobEncode(id, value)
+	if err != nil {
+		return err
+	}
+	if len(body) > c.mtu {
+		return ErrMessageTooLarge
+	}
+
+	return c.manager.sendPacketTo(ctx, c.addr, dst, Envelope{MsgType: id, Msg: value, From: c.addr})
+}
+
+// ReadFrom implements the PacketConn interface.
+func (c *LocalPacketConn) ReadFrom(ctx context.Context) (Envelope, error) {
+	select {
+	case env := <-c.in:
+		return env, nil
+	case <-c.done:
+		return Envelope{}, ErrClosed
+	case <-ctx.Done():
+		return Envelope{}, ctx.Err()
+	}
+}
+
+// Close implements the PacketConn interface.
+func (c *LocalPacketConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.manager.unregisterPacketConn(c.addr)
+	close(c.done)
+	return nil
+}
+
+// Local implements the PacketConn interface.
+func (c *LocalPacketConn) Local() Address {
+	return c.addr
+}
+
+func (c *LocalPacketConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// registerPacketConn binds addr to ch, so sendPacketTo can later route
+// datagrams addressed to it.
+func (lm *LocalManager) registerPacketConn(addr Address, ch chan Envelope) error {
+	lm.Lock()
+	defer lm.Unlock()
+	if _, ok := lm.packetConns[addr]; ok {
+		return fmt.Errorf("network: %s already has a PacketConn", addr)
+	}
+	lm.packetConns[addr] = ch
+	return nil
+}
+
+func (lm *LocalManager) unregisterPacketConn(addr Address) {
+	lm.Lock()
+	defer lm.Unlock()
+	delete(lm.packetConns, addr)
+}
+
+// sendPacketTo delivers env to whatever LocalPacketConn is registered at
+// dst, if any, subject to the manager's Partition/SetLossRate fault
+// injection (latency and bandwidth, which need a destination Conn's
+// close semantics to delay against, are stream-Conn-only; see
+// faultState.schedule). As with a real UDP send, a missing destination or
+// a dropped datagram is not an error for the sender.
+func (lm *LocalManager) sendPacketTo(ctx context.Context, from, dst Address, env Envelope) error {
+	lm.faults.Lock()
+	drop := lm.faults.dropped(from, dst)
+	lm.faults.Unlock()
+	if drop {
+		return nil
+	}
+
+	lm.Lock()
+	ch, ok := lm.packetConns[dst]
+	lm.Unlock()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case ch <- env:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UDPPacketConn is a PacketConn backed by a real UDP socket. Each
+// WriteTo/ReadFrom corresponds to exactly one datagram: there is no
+// framing beyond gob-encoding the (PacketTypeID, value) pair, since UDP
+// already preserves datagram boundaries.
+type UDPPacketConn struct {
+	conn *net.UDPConn
+	addr Address
+	mtu  int
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewUDPPacketConn opens a UDP socket on addr with the default MTU.
+func NewUDPPacketConn(addr Address) (*UDPPacketConn, error) {
+	return NewUDPPacketConnMTU(addr, defaultPacketMTU)
+}
+
+// NewUDPPacketConnMTU is like NewUDPPacketConn but caps payloads at mtu
+// bytes instead of the default.
+func NewUDPPacketConnMTU(addr Address, mtu int) (*UDPPacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.NetworkAddress())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPPacketConn{conn: conn, addr: Address(conn.LocalAddr().String()), mtu: mtu}, nil
+}
+
+// WriteTo implements the PacketConn interface.
+func (c *UDPPacketConn) WriteTo(ctx context.Context, msg interface{}, dst Address) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	id, err := packetTypeOf(msg)
+	if err != nil {
+		return err
+	}
+	body, err := gobEncode(id, underlyingValue(msg))
+	if err != nil {
+		return err
+	}
+	if len(body) > c.mtu {
+		return ErrMessageTooLarge
+	}
+
+	udpDst, err := net.ResolveUDPAddr("udp", dst.NetworkAddress())
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteToUDP(body, udpDst)
+	return err
+}
+
+// ReadFrom implements the PacketConn interface.
+func (c *UDPPacketConn) ReadFrom(ctx context.Context) (Envelope, error) {
+	buf := make([]byte, c.mtu)
+	for {
+		select {
+		case <-ctx.Done():
+			return Envelope{}, ctx.Err()
+		default:
+		}
+		if c.isClosed() {
+			return Envelope{}, ErrClosed
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(packetDeadlineStep))
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err == nil {
+			id, msg, err := gobDecode(buf[:n])
+			if err != nil {
+				return Envelope{}, err
+			}
+			return Envelope{MsgType: id, Msg: msg, From: Address(from.String())}, nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		return Envelope{}, c.translateErr(err)
+	}
+}
+
+// Close implements the PacketConn interface.
+func (c *UDPPacketConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// Local implements the PacketConn interface.
+func (c *UDPPacketConn) Local() Address {
+	return c.addr
+}
+
+func (c *UDPPacketConn) translateErr(err error) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	return err
+}
+
+func (c *UDPPacketConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// packetBackends wires up the constructor needed to run the same test body
+// against a given PacketConn implementation.
+var packetBackends = []struct {
+	name    string
+	newConn func(addr Address) (PacketConn, error)
+}{
+	{
+		name: "local",
+		newConn: func(addr Address) (PacketConn, error) {
+			return NewLocalPacketConn(addr)
+		},
+	},
+	{
+		name: "udp",
+		newConn: func(addr Address) (PacketConn, error) {
+			return NewUDPPacketConn(NewLocalAddress("127.0.0.1:0"))
+		},
+	},
+}
+
+func TestPacketConnWriteToReadFrom(t *testing.T) {
+	for _, b := range packetBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			a, err := b.newConn(nextAddr())
+			assert.Nil(t, err)
+			defer a.Close()
+
+			bConn, err := b.newConn(nextAddr())
+			assert.Nil(t, err)
+			defer bConn.Close()
+
+			assert.Nil(t, a.WriteTo(context.TODO(), &SimpleMessage{7}, bConn.Local()))
+
+			env, err := bConn.ReadFrom(context.TODO())
+			assert.Nil(t, err)
+			assert.Equal(t, SimpleMessage{7}, env.Msg.(SimpleMessage))
+			assert.Equal(t, a.Local(), env.From)
+		})
+	}
+}
+
+func TestPacketConnMessageTooLarge(t *testing.T) {
+	mgr := NewLocalManager()
+	conn, err := NewLocalPacketConnWithManager(mgr, nextAddr(), 4)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	err = conn.WriteTo(context.TODO(), &SimpleMessage{12345}, nextAddr())
+	assert.Equal(t, ErrMessageTooLarge, err)
+}
+
+// TestLocalPacketConnPartition checks that LocalPacketConn, like LocalConn,
+// honors the manager's Partition: a datagram between two partitioned
+// addresses never arrives.
+func TestLocalPacketConnPartition(t *testing.T) {
+	mgr := NewLocalManager()
+	addrA := nextAddr()
+	addrB := nextAddr()
+
+	a, err := NewLocalPacketConnWithManager(mgr, addrA, defaultPacketMTU)
+	assert.Nil(t, err)
+	defer a.Close()
+	b, err := NewLocalPacketConnWithManager(mgr, addrB, defaultPacketMTU)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	mgr.Partition(addrA, addrB)
+	assert.Nil(t, a.WriteTo(context.TODO(), &SimpleMessage{7}, addrB))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = b.ReadFrom(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestLocalPacketConnCloseReadFrom(t *testing.T) {
+	conn, err := NewLocalPacketConn(nextAddr())
+	assert.Nil(t, err)
+
+	assert.Nil(t, conn.Close())
+	assert.Equal(t, ErrClosed, conn.Close())
+
+	_, err = conn.ReadFrom(context.TODO())
+	assert.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,412 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// PubKey is a peer's long-term X25519 public key, used to authenticate it
+// during the SecureConn handshake.
+type PubKey [32]byte
+
+// Identity is a long-term X25519 keypair identifying a peer.
+type Identity struct {
+	Public  PubKey
+	private *ecdh.PrivateKey
+}
+
+// NewIdentity generates a fresh long-term X25519 identity.
+func NewIdentity() (Identity, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Identity{}, err
+	}
+	var pub PubKey
+	copy(pub[:], priv.PublicKey().Bytes())
+	return Identity{Public: pub, private: priv}, nil
+}
+
+// ErrHandshake is returned, describing the underlying cause, whenever the
+// SecureConn handshake fails (mismatched identity, malformed message,
+// transport error while handshaking, ...). The underlying Conn is always
+// closed before ErrHandshake is returned.
+type ErrHandshake struct {
+	reason string
+}
+
+func (e *ErrHandshake) Error() string {
+	return "network: handshake failed: " + e.reason
+}
+
+func newHandshakeErr(format string, args ...interface{}) error {
+	return &ErrHandshake{reason: fmt.Sprintf(format, args...)}
+}
+
+// secureHandshake is exchanged once, in the clear, by both ends of a
+// SecureConn: the long-term Identity authenticates the peer, the Ephemeral
+// key feeds the X25519 exchange the session key is derived from.
+type secureHandshake struct {
+	Identity  PubKey
+	Ephemeral PubKey
+}
+
+var secureHandshakeType = RegisterPacketType(&secureHandshake{})
+
+// secureFrame carries one encrypted application message over the inner
+// Conn. Nonce is the sender-side monotonic sequence number, reconstructed
+// into an AEAD nonce on the receiving end.
+type secureFrame struct {
+	Nonce      uint64
+	Ciphertext []byte
+}
+
+var secureFrameType = RegisterPacketType(&secureFrame{})
+
+// SecureConn decorates any Conn with an authenticated-handshake-derived
+// ChaCha20-Poly1305-equivalent (AES-256-GCM) session: every Send is sealed
+// and every Receive is opened before the caller ever sees it.
+type SecureConn struct {
+	inner     Conn
+	remotePub PubKey
+
+	seal    cipher.AEAD
+	open    cipher.AEAD
+	sealSeq uint64
+	openSeq uint64
+}
+
+// NewSecureConn performs the authenticated handshake over inner as the
+// dialing side: it proves local's identity, verifies the remote presents
+// the expected remote PubKey, and derives the session keys. On any failure
+// inner is closed and an *ErrHandshake is returned.
+func NewSecureConn(ctx context.Context, inner Conn, local Identity, remote PubKey) (Conn, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("generating ephemeral key: %v", err)
+	}
+
+	if err := sendHandshake(ctx, inner, local, eph); err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("sending handshake: %v", err)
+	}
+
+	hs, err := receiveHandshake(ctx, inner)
+	if err != nil {
+		inner.Close()
+		return nil, err
+	}
+	if hs.Identity != remote {
+		inner.Close()
+		return nil, newHandshakeErr("remote identity does not match expected key")
+	}
+
+	return finishHandshake(ctx, inner, local, eph, hs, true)
+}
+
+// NewSecureListener wraps inner so that every Conn handed to the user's
+// callback has already completed the SecureConn handshake as the
+// responding side. inner's callback never sees unauthenticated peers:
+// connections that fail the handshake are closed and never reach fn.
+func NewSecureListener(inner Listener, local Identity) Listener {
+	return &secureListener{inner: inner, local: local}
+}
+
+type secureListener struct {
+	inner Listener
+	local Identity
+}
+
+func (l *secureListener) Listen(fn func(Conn)) error {
+	return l.inner.Listen(func(c Conn) {
+		sc, err := acceptSecureConn(l.local, c)
+		if err != nil {
+			return
+		}
+		fn(sc)
+	})
+}
+
+func (l *secureListener) Stop() error {
+	return l.inner.Stop()
+}
+
+// Stats implements the Listener interface.
+func (l *secureListener) Stats() ListenerStats {
+	return l.inner.Stats()
+}
+
+// acceptSecureConn runs the responding side of the handshake over c.
+func acceptSecureConn(local Identity, c Conn) (*SecureConn, error) {
+	ctx := context.Background()
+
+	hs, err := receiveHandshake(ctx, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := sendHandshake(ctx, c, local, eph); err != nil {
+		c.Close()
+		return nil, newHandshakeErr("sending handshake: %v", err)
+	}
+
+	return finishHandshake(ctx, c, local, eph, hs, false)
+}
+
+func sendHandshake(ctx context.Context, c Conn, local Identity, eph *ecdh.PrivateKey) error {
+	var ephPub PubKey
+	copy(ephPub[:], eph.PublicKey().Bytes())
+	return c.Send(ctx, &secureHandshake{Identity: local.Public, Ephemeral: ephPub})
+}
+
+func receiveHandshake(ctx context.Context, c Conn) (secureHandshake, error) {
+	p, err := c.Receive(ctx)
+	if err != nil {
+		return secureHandshake{}, newHandshakeErr("receiving handshake: %v", err)
+	}
+	hs, ok := p.Msg.(secureHandshake)
+	if !ok {
+		return secureHandshake{}, newHandshakeErr("unexpected message type during handshake")
+	}
+	return hs, nil
+}
+
+// finishHandshake turns the local identity and ephemeral key and the peer's
+// handshake message into an established SecureConn. The session keys are
+// derived from three combined ECDH outputs (ephemeral-ephemeral, plus each
+// side's static key crossed with the other's ephemeral key, X3DH-style) so
+// that deriving the right keys requires actually holding the private key
+// behind the Identity a peer claims, not just echoing its public bytes: see
+// ErrHandshake returned by confirmHandshake for how a mismatch surfaces.
+func finishHandshake(ctx context.Context, inner Conn, local Identity, eph *ecdh.PrivateKey, remoteHandshake secureHandshake, initiator bool) (*SecureConn, error) {
+	remoteStatic, err := ecdh.X25519().NewPublicKey(remoteHandshake.Identity[:])
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("invalid identity key: %v", err)
+	}
+	remoteEph, err := ecdh.X25519().NewPublicKey(remoteHandshake.Ephemeral[:])
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("invalid ephemeral key: %v", err)
+	}
+
+	ephEph, err := eph.ECDH(remoteEph)
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("computing ephemeral shared secret: %v", err)
+	}
+	staticEph, err := local.private.ECDH(remoteEph)
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("computing static/ephemeral shared secret: %v", err)
+	}
+	ephStatic, err := eph.ECDH(remoteStatic)
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("computing ephemeral/static shared secret: %v", err)
+	}
+
+	// termIR is the DH between the initiator's static key and the
+	// responder's ephemeral key, termRI the mirror DH between the
+	// responder's static key and the initiator's ephemeral key. Either
+	// side can compute both (ECDH is commutative) but only by actually
+	// holding the static private key its Identity claims, so labeling
+	// them the same way on both ends binds the session keys to both
+	// parties' long-term identities, not just their fresh ephemerals.
+	var termIR, termRI []byte
+	if initiator {
+		termIR, termRI = staticEph, ephStatic
+	} else {
+		termIR, termRI = ephStatic, staticEph
+	}
+	shared := make([]byte, 0, len(ephEph)+len(termIR)+len(termRI))
+	shared = append(shared, ephEph...)
+	shared = append(shared, termIR...)
+	shared = append(shared, termRI...)
+
+	sealKey, openKey := deriveSessionKeys(shared, initiator)
+	seal, err := newAEAD(sealKey)
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("setting up seal cipher: %v", err)
+	}
+	open, err := newAEAD(openKey)
+	if err != nil {
+		inner.Close()
+		return nil, newHandshakeErr("setting up open cipher: %v", err)
+	}
+
+	sc := &SecureConn{
+		inner:     inner,
+		remotePub: remoteHandshake.Identity,
+		seal:      seal,
+		open:      open,
+	}
+	if err := confirmHandshake(ctx, sc); err != nil {
+		inner.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// secureConfirm is the first message exchanged over a SecureConn, right
+// after session keys are derived, purely to prove both sides actually
+// arrived at the same keys.
+type secureConfirm struct {
+	OK bool
+}
+
+var secureConfirmType = RegisterPacketType(&secureConfirm{})
+
+// confirmHandshake exchanges one secureConfirm message in each direction
+// over sc. A peer that derived different session keys — e.g. because it
+// declared an Identity it doesn't hold the matching private key for —
+// fails to decrypt the other side's message, so the mismatch surfaces here
+// as an *ErrHandshake instead of a confusing failure the first time real
+// application data is exchanged.
+func confirmHandshake(ctx context.Context, sc *SecureConn) error {
+	if err := sc.Send(ctx, &secureConfirm{OK: true}); err != nil {
+		return newHandshakeErr("sending confirmation: %v", err)
+	}
+	p, err := sc.Receive(ctx)
+	if err != nil {
+		return newHandshakeErr("receiving confirmation: %v", err)
+	}
+	if _, ok := p.Msg.(secureConfirm); !ok {
+		return newHandshakeErr("unexpected message type during confirmation")
+	}
+	return nil
+}
+
+// deriveSessionKeys turns the combined X25519 shared secret (see
+// finishHandshake) into a pair of directional AEAD keys, one per side, so
+// that a sender's seal key always matches the receiver's open key.
+func deriveSessionKeys(shared []byte, initiator bool) (sealKey, openKey [32]byte) {
+	material := hkdfSHA256(shared, []byte("network/secureconn session keys"), 64)
+	var k1, k2 [32]byte
+	copy(k1[:], material[:32])
+	copy(k2[:], material[32:])
+	if initiator {
+		return k1, k2
+	}
+	return k2, k1
+}
+
+// hkdfSHA256 is a minimal HKDF (RFC 5869) extract-and-expand over
+// HMAC-SHA256, used only to turn the ECDH shared secret into session keys.
+func hkdfSHA256(secret, info []byte, outLen int) []byte {
+	extract := hmac.New(sha256.New, nil)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, t []byte
+	for counter := byte(1); len(out) < outLen; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:outLen]
+}
+
+func newAEAD(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonceFor turns a monotonic sequence number into a fixed-size AEAD nonce.
+func nonceFor(seq uint64, size int) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], seq)
+	return nonce
+}
+
+// Send implements the Conn interface: msg is gob-encoded, sealed with the
+// session's seal key under an incrementing nonce, and shipped as a
+// secureFrame over the inner Conn.
+func (c *SecureConn) Send(ctx context.Context, msg interface{}) error {
+	id, err := packetTypeOf(msg)
+	if err != nil {
+		return err
+	}
+	body, err := gobEncode(id, underlyingValue(msg))
+	if err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint64(&c.sealSeq, 1) - 1
+	ct := c.seal.Seal(nil, nonceFor(seq, c.seal.NonceSize()), body, nil)
+
+	return c.inner.Send(ctx, &secureFrame{Nonce: seq, Ciphertext: ct})
+}
+
+// Receive implements the Conn interface: it opens the next secureFrame and
+// gob-decodes the plaintext back into a Packet.
+func (c *SecureConn) Receive(ctx context.Context) (Packet, error) {
+	p, err := c.inner.Receive(ctx)
+	if err != nil {
+		return Packet{}, err
+	}
+	sf, ok := p.Msg.(secureFrame)
+	if !ok {
+		return Packet{}, fmt.Errorf("network: expected secureFrame, got %T", p.Msg)
+	}
+
+	expected := atomic.AddUint64(&c.openSeq, 1) - 1
+	if sf.Nonce != expected {
+		return Packet{}, fmt.Errorf("network: out-of-order secure frame: got seq %d, expected %d", sf.Nonce, expected)
+	}
+
+	plain, err := c.open.Open(nil, nonceFor(sf.Nonce, c.open.NonceSize()), sf.Ciphertext, nil)
+	if err != nil {
+		return Packet{}, fmt.Errorf("network: decrypting frame: %v", err)
+	}
+
+	id, m, err := gobDecode(plain)
+	if err != nil {
+		return Packet{}, err
+	}
+	return Packet{MsgType: id, Msg: m, From: c.inner.Remote()}, nil
+}
+
+// Close implements the Conn interface.
+func (c *SecureConn) Close() error {
+	return c.inner.Close()
+}
+
+// Local implements the Conn interface.
+func (c *SecureConn) Local() Address {
+	return c.inner.Local()
+}
+
+// Remote implements the Conn interface.
+func (c *SecureConn) Remote() Address {
+	return c.inner.Remote()
+}
+
+// RemotePubKey returns the long-term identity public key the remote peer
+// authenticated with during the handshake.
+func (c *SecureConn) RemotePubKey() PubKey {
+	return c.remotePub
+}
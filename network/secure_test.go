@@ -0,0 +1,139 @@
+package network
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSecureConnHandshake checks that two peers with matching expectations
+// complete the handshake and can then exchange an encrypted message.
+func TestSecureConnHandshake(t *testing.T) {
+	serverID, err := NewIdentity()
+	assert.Nil(t, err)
+	clientID, err := NewIdentity()
+	assert.Nil(t, err)
+
+	addr := nextAddr()
+	listener, err := NewLocalListener(addr)
+	assert.Nil(t, err)
+	secureListener := NewSecureListener(listener, serverID)
+
+	var ready = make(chan bool)
+	var serverMsg = make(chan SimpleMessage, 1)
+	go func() {
+		ready <- true
+		secureListener.Listen(func(c Conn) {
+			nm, err := c.Receive(context.TODO())
+			assert.Nil(t, err)
+			serverMsg <- nm.Msg.(SimpleMessage)
+		})
+	}()
+	<-ready
+	if !waitListening(defaultLocalManager, addr) {
+		t.Fatal("listener never came up")
+	}
+
+	inner, err := NewLocalConn(nextAddr(), addr)
+	assert.Nil(t, err)
+	secure, err := NewSecureConn(context.TODO(), inner, clientID, serverID.Public)
+	assert.Nil(t, err)
+
+	assert.Nil(t, secure.Send(context.TODO(), &SimpleMessage{42}))
+	assert.Equal(t, SimpleMessage{42}, <-serverMsg)
+
+	assert.Equal(t, serverID.Public, secure.(*SecureConn).RemotePubKey())
+
+	secureListener.Stop()
+}
+
+// TestSecureConnMismatchedIdentity checks that a client expecting the wrong
+// server identity fails the handshake instead of silently connecting.
+func TestSecureConnMismatchedIdentity(t *testing.T) {
+	serverID, err := NewIdentity()
+	assert.Nil(t, err)
+	wrongID, err := NewIdentity()
+	assert.Nil(t, err)
+	clientID, err := NewIdentity()
+	assert.Nil(t, err)
+
+	addr := nextAddr()
+	listener, err := NewLocalListener(addr)
+	assert.Nil(t, err)
+	secureListener := NewSecureListener(listener, serverID)
+
+	var ready = make(chan bool)
+	go func() {
+		ready <- true
+		secureListener.Listen(func(c Conn) {})
+	}()
+	<-ready
+	if !waitListening(defaultLocalManager, addr) {
+		t.Fatal("listener never came up")
+	}
+
+	inner, err := NewLocalConn(nextAddr(), addr)
+	assert.Nil(t, err)
+	_, err = NewSecureConn(context.TODO(), inner, clientID, wrongID.Public)
+	assert.NotNil(t, err)
+	_, ok := err.(*ErrHandshake)
+	assert.True(t, ok, "expected *ErrHandshake, got %T", err)
+
+	secureListener.Stop()
+}
+
+// TestSecureConnImpersonationFails checks that a responder who merely
+// echoes serverID.Public as its claimed Identity, without holding the
+// matching private key, cannot complete the handshake: the session keys
+// are bound to each side's static private key, not just fresh ephemerals,
+// so an impostor derives different keys and the mismatch surfaces as
+// *ErrHandshake instead of a silent, unauthenticated connection.
+func TestSecureConnImpersonationFails(t *testing.T) {
+	serverID, err := NewIdentity()
+	assert.Nil(t, err)
+	impostorID, err := NewIdentity()
+	assert.Nil(t, err)
+	clientID, err := NewIdentity()
+	assert.Nil(t, err)
+
+	addr := nextAddr()
+	listener, err := NewLocalListener(addr)
+	assert.Nil(t, err)
+
+	var ready = make(chan bool)
+	go func() {
+		ready <- true
+		listener.Listen(func(c Conn) {
+			hs, err := receiveHandshake(context.TODO(), c)
+			assert.Nil(t, err)
+
+			eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+			assert.Nil(t, err)
+			// Declare serverID's public key as our Identity, but derive
+			// keys with impostorID's own private key: we never touch
+			// serverID.private.
+			claimed := Identity{Public: serverID.Public, private: impostorID.private}
+			assert.Nil(t, sendHandshake(context.TODO(), c, claimed, eph))
+
+			// The resulting session keys won't match what the client
+			// derives, so this is expected to fail too; the assertion that
+			// matters is on the client's side below.
+			finishHandshake(context.TODO(), c, claimed, eph, hs, false)
+		})
+	}()
+	<-ready
+	if !waitListening(defaultLocalManager, addr) {
+		t.Fatal("listener never came up")
+	}
+
+	inner, err := NewLocalConn(nextAddr(), addr)
+	assert.Nil(t, err)
+	_, err = NewSecureConn(context.TODO(), inner, clientID, serverID.Public)
+	assert.NotNil(t, err)
+	_, ok := err.(*ErrHandshake)
+	assert.True(t, ok, "expected *ErrHandshake, got %T", err)
+}
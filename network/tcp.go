@@ -0,0 +1,366 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxTCPFrameSize bounds how large a single length-prefixed frame may be,
+// to avoid a misbehaving peer making us allocate unbounded memory.
+const maxTCPFrameSize = 32 << 20 // 32MB
+
+// tcpDeadlineStep is how often Send/Receive re-check ctx.Done() while
+// waiting on the underlying socket, by pushing a short read/write deadline.
+const tcpDeadlineStep = 100 * time.Millisecond
+
+// TCPConn is a Conn backed by a real net.Conn. Frames are length-prefixed:
+// a 4-byte big-endian size followed by a gob-encoded (PacketTypeID, value)
+// pair.
+type TCPConn struct {
+	local, remote Address
+	conn          net.Conn
+	reader        *bufio.Reader
+	stats         *connStats
+
+	mu     sync.Mutex
+	closed bool
+
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+// NewTCPConn dials remote over TCP and wraps the resulting socket.
+func NewTCPConn(remote Address) (*TCPConn, error) {
+	conn, err := net.Dial("tcp", remote.NetworkAddress())
+	if err != nil {
+		return nil, err
+	}
+	return newTCPConn(conn, Address(conn.LocalAddr().String()), remote), nil
+}
+
+func newTCPConn(conn net.Conn, local, remote Address) *TCPConn {
+	return &TCPConn{
+		local:  local,
+		remote: remote,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		stats:  newConnStats(local, remote, "tcp"),
+	}
+}
+
+// connStats implements connStatsProvider, so diagnostics code can register
+// and read this conn's counters without TCPConn exposing them itself.
+func (c *TCPConn) connStats() *connStats {
+	return c.stats
+}
+
+// Send implements the Conn interface.
+func (c *TCPConn) Send(ctx context.Context, msg interface{}) error {
+	id, err := packetTypeOf(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	body, err := gobEncode(id, underlyingValue(msg))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxTCPFrameSize {
+		return fmt.Errorf("network: encoded frame of %d bytes exceeds max size %d", len(body), maxTCPFrameSize)
+	}
+
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(body)))
+	copy(buf[4:], body)
+
+	if err := c.writeWithDeadline(ctx, buf); err != nil {
+		return err
+	}
+	c.stats.recordSent(len(buf))
+	return nil
+}
+
+// Receive implements the Conn interface.
+func (c *TCPConn) Receive(ctx context.Context) (Packet, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.isClosed() {
+		return Packet{}, ErrClosed
+	}
+
+	var sizeBuf [4]byte
+	if err := c.readFullWithDeadline(ctx, sizeBuf[:]); err != nil {
+		return Packet{}, c.translateErr(err)
+	}
+
+	size := binary.BigEndian.Uint32(sizeBuf[:])
+	if size > maxTCPFrameSize {
+		return Packet{}, fmt.Errorf("network: frame of %d bytes exceeds max size %d", size, maxTCPFrameSize)
+	}
+
+	body := make([]byte, size)
+	if err := c.readFullWithDeadline(ctx, body); err != nil {
+		return Packet{}, c.translateErr(err)
+	}
+
+	id, msg, err := gobDecode(body)
+	if err != nil {
+		return Packet{}, err
+	}
+	c.stats.recordReceived(4 + len(body))
+	return Packet{MsgType: id, Msg: msg, From: c.remote}, nil
+}
+
+// readFullWithDeadline fills buf entirely, re-pushing a short read deadline
+// in a loop so a cancelled ctx is noticed promptly instead of blocking
+// forever on a peer that never speaks. Progress made before a deadline trip
+// is preserved across retries.
+func (c *TCPConn) readFullWithDeadline(ctx context.Context, buf []byte) error {
+	read := 0
+	for read < len(buf) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if c.isClosed() {
+			return ErrClosed
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(tcpDeadlineStep))
+		n, err := readFull(c.reader, buf[read:])
+		read += n
+		if err == nil {
+			c.conn.SetReadDeadline(time.Time{})
+			return nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+// writeWithDeadline writes buf entirely, re-pushing a short write deadline
+// in a loop so a cancelled ctx is noticed promptly.
+func (c *TCPConn) writeWithDeadline(ctx context.Context, buf []byte) error {
+	written := 0
+	for written < len(buf) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if c.isClosed() {
+			return ErrClosed
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(tcpDeadlineStep))
+		n, err := c.conn.Write(buf[written:])
+		written += n
+		if err == nil {
+			c.conn.SetWriteDeadline(time.Time{})
+			return nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+// translateErr maps a Read/Write error to ErrClosed, either because Close
+// was already called locally, or because the error itself proves the
+// remote side hung up first (a half-closed TCP socket surfaces that as
+// io.EOF/io.ErrUnexpectedEOF rather than anything isClosed can see). The
+// latter case also marks the conn closed locally, so a remote-initiated
+// close is visible here just as it is for LocalConn's shared pipeState.
+func (c *TCPConn) translateErr(err error) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		if c.markClosed() {
+			c.conn.Close()
+		}
+		return ErrClosed
+	}
+	return err
+}
+
+func (c *TCPConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// markClosed flips closed to true if it isn't already, reporting whether
+// this call was the one to do so, so exactly one caller (an explicit Close,
+// or a read/write that discovers the remote side hung up) performs the
+// actual socket teardown and stats bookkeeping.
+func (c *TCPConn) markClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	c.stats.closed()
+	return true
+}
+
+// Close implements the Conn interface. A close by the remote side is only
+// seen once a Receive has hit it (see translateErr); until then Close
+// returns nil even if the remote side already closed.
+func (c *TCPConn) Close() error {
+	if !c.markClosed() {
+		return ErrClosed
+	}
+	return c.conn.Close()
+}
+
+// Local implements the Conn interface.
+func (c *TCPConn) Local() Address {
+	return c.local
+}
+
+// Remote implements the Conn interface.
+func (c *TCPConn) Remote() Address {
+	return c.remote
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// TCPListener is a Listener backed by a net.Listener, running the canonical
+// accept loop: Accept, dispatch to a handler goroutine, repeat.
+type TCPListener struct {
+	addr     Address
+	listener net.Listener
+	stats    *connRegistry
+
+	mu        sync.Mutex
+	listening bool
+}
+
+// NewTCPListener opens a TCP socket on addr, ready to Listen.
+func NewTCPListener(addr Address) (*TCPListener, error) {
+	ln, err := net.Listen("tcp", addr.NetworkAddress())
+	if err != nil {
+		return nil, err
+	}
+	return &TCPListener{addr: Address(ln.Addr().String()), listener: ln, stats: newConnRegistry()}, nil
+}
+
+// Listen implements the Listener interface.
+func (l *TCPListener) Listen(fn func(Conn)) error {
+	l.mu.Lock()
+	if l.listening {
+		l.mu.Unlock()
+		return fmt.Errorf("network: listener on %s is already listening", l.addr)
+	}
+	l.listening = true
+	l.mu.Unlock()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.mu.Lock()
+			stopped := !l.listening
+			l.mu.Unlock()
+			if stopped {
+				return nil
+			}
+			return err
+		}
+		remote := Address(conn.RemoteAddr().String())
+		c := newTCPConn(conn, l.addr, remote)
+		l.stats.add(c.stats)
+		go fn(c)
+	}
+}
+
+// Addr returns the address this listener is actually bound to, which may
+// differ from the one requested if e.g. port 0 was given.
+func (l *TCPListener) Addr() Address {
+	return l.addr
+}
+
+// Stop implements the Listener interface.
+func (l *TCPListener) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.listening {
+		return fmt.Errorf("network: listener on %s is not listening", l.addr)
+	}
+	l.listening = false
+	return l.listener.Close()
+}
+
+// Stats implements the Listener interface.
+func (l *TCPListener) Stats() ListenerStats {
+	return l.stats.stats()
+}
+
+// TCPHost dials out over TCP.
+type TCPHost struct {
+	addr  Address
+	stats *connRegistry
+}
+
+// NewTCPHost creates a TCPHost known by the given address, which keys its
+// own entry in DiagnoseNetwork's result. Connect does not bind to it:
+// outgoing connections use a local address chosen by the OS.
+func NewTCPHost(addr Address) (*TCPHost, error) {
+	return &TCPHost{addr: addr, stats: newConnRegistry()}, nil
+}
+
+// Connect implements the Host interface.
+func (h *TCPHost) Connect(remote Address) (Conn, error) {
+	c, err := NewTCPConn(remote)
+	if err != nil {
+		return nil, err
+	}
+	h.stats.add(c.stats)
+	return c, nil
+}
+
+// Diagnose implements the Host interface.
+func (h *TCPHost) Diagnose(ctx context.Context) ([]*ConnInfo, error) {
+	return h.stats.snapshot(), nil
+}
+
+// DiagnoseNetwork returns this host's own Diagnose output and, for
+// depth > 0, that of every peer it is currently connected to, keyed by
+// address. Only direct peers appear in the result, whatever depth is:
+// entries a peer gathers from its own peers are not included.
+func (h *TCPHost) DiagnoseNetwork(ctx context.Context, depth int) (map[Address][]*ConnInfo, error) {
+	return diagnoseNetwork(ctx, h.addr, h, depth)
+}